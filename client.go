@@ -2,22 +2,106 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"os"
 
-	"github.com/xanzy/go-gitlab"
+	"github.com/hashicorp/go-retryablehttp"
+	"gitlab.com/gitlab-org/api/client-go"
 )
 
 func createGitlabClient() (*gitlab.Client, error) {
-	transCfg := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	transport, err := buildTLSTransport()
+	if err != nil {
+		return nil, err
+	}
+
+	retryClient := retryablehttp.NewClient()
+	retryClient.HTTPClient.Transport = transport
+	retryClient.Logger = nil
+
+	clientOptions := []gitlab.ClientOptionFunc{
+		gitlab.WithBaseURL(ciAPIV4URL),
+		gitlab.WithHTTPClient(retryClient.StandardClient()),
+	}
+
+	switch selectAuthMode() {
+	case authOAuth:
+		return gitlab.NewOAuthClient(os.Getenv("GITLAB_OAUTH_TOKEN"), clientOptions...)
+	case authJobToken:
+		return gitlab.NewJobClient(os.Getenv("CI_JOB_TOKEN"), clientOptions...)
+	default:
+		return gitlab.NewClient(gitlabAPIToken, clientOptions...)
 	}
-	httpClient := &http.Client{
-		Transport: transCfg,
+}
+
+type authMode int
+
+const (
+	authPersonalAccessToken authMode = iota
+	authOAuth
+	authJobToken
+)
+
+// selectAuthMode picks which of the supported auth mechanisms
+// createGitlabClient uses. GITLAB_OAUTH_TOKEN takes precedence over
+// everything else. CI_JOB_TOKEN is used only when GITLAB_API_TOKEN is not
+// set, since GitLab sets CI_JOB_TOKEN in every pipeline job whether or not
+// the caller chose it.
+func selectAuthMode() authMode {
+	switch {
+	case os.Getenv("GITLAB_OAUTH_TOKEN") != "":
+		return authOAuth
+	case os.Getenv("CI_JOB_TOKEN") != "" && gitlabAPIToken == "":
+		return authJobToken
+	default:
+		return authPersonalAccessToken
 	}
+}
+
+// buildTLSTransport defaults to verifying the server certificate against the
+// system pool. GITLAB_CA_CERT / GITLAB_CA_CERT_FILE adds a private CA to
+// that pool for self-hosted instances, and GITLAB_INSECURE=1 is an explicit
+// opt-out for lab environments.
+func buildTLSTransport() (*http.Transport, error) {
+	tlsConfig := &tls.Config{}
 
-	git, err := gitlab.NewClient(gitlabAPIToken, gitlab.WithBaseURL(ciAPIV4URL), gitlab.WithHTTPClient(httpClient))
+	if os.Getenv("GITLAB_INSECURE") == "1" {
+		tlsConfig.InsecureSkipVerify = true
+		return &http.Transport{TLSClientConfig: tlsConfig}, nil
+	}
+
+	caCert, err := loadCACert()
 	if err != nil {
 		return nil, err
 	}
-	return git, nil
+
+	if caCert != nil {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("failed to append GITLAB_CA_CERT to certificate pool")
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	return &http.Transport{TLSClientConfig: tlsConfig}, nil
+}
+
+func loadCACert() ([]byte, error) {
+	if cert := os.Getenv("GITLAB_CA_CERT"); cert != "" {
+		return []byte(cert), nil
+	}
+
+	if certFile := os.Getenv("GITLAB_CA_CERT_FILE"); certFile != "" {
+		return ioutil.ReadFile(certFile)
+	}
+
+	return nil, nil
 }
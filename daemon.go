@@ -0,0 +1,153 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// runDaemonMode registers one cron entry per template under
+// issuesRelativePath and blocks until SIGINT or SIGTERM is received, at
+// which point it waits for any in-flight job to finish before returning.
+func runDaemonMode() {
+	stateFilePath := os.Getenv("STATE_FILE_PATH")
+	if stateFilePath == "" {
+		stateFilePath = defaultStateFilePath
+	}
+
+	issuesRelativePath = os.Getenv("RECURRING_ISSUES_PATH")
+	if issuesRelativePath == "" {
+		issuesRelativePath = "./recurring_issue_templates/"
+	}
+
+	ciAPIV4URL = os.Getenv("GITLAB_API_URL")
+	if ciAPIV4URL == "" {
+		log.Fatal("Environment variable 'GITLAB_API_URL' not found. This is required when running with --daemon.")
+	}
+
+	ciProjectID = os.Getenv("GITLAB_PROJECT_ID")
+	if ciProjectID == "" {
+		log.Fatal("Environment variable 'GITLAB_PROJECT_ID' not found. This is required when running with --daemon.")
+	}
+
+	state, err := loadRunState(stateFilePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	scheduler := cron.New()
+
+	err = filepath.Walk(issuesRelativePath, scheduleTemplate(scheduler, state))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	scheduler.Start()
+	log.Println("Daemon started with", len(scheduler.Entries()), "scheduled template(s)")
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+
+	log.Println("Shutting down, waiting for any in-flight job to finish")
+	<-scheduler.Stop().Done()
+}
+
+// alreadyFired reports whether firedAt falls within the same scheduled
+// period as lastFired, meaning a fire for it was already recorded and this
+// tick (most likely a restart landing on the same period) would create a
+// duplicate issue.
+func alreadyFired(sched cron.Schedule, lastFired time.Time, firedAt time.Time) bool {
+	if lastFired == time.Unix(0, 0) {
+		return false
+	}
+
+	return sched.Next(lastFired).After(firedAt)
+}
+
+func scheduleTemplate(scheduler *cron.Cron, state *runState) filepath.WalkFunc {
+	return func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || filepath.Ext(path) != ".md" {
+			return nil
+		}
+
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		data, err := parseMetadata(contents)
+		if err != nil {
+			return err
+		}
+
+		templatePath := path
+		crontab := data.Crontab
+
+		// cron.ParseStandard is stricter than the cronexpr parser used by
+		// the CI-pipeline path and --dry-run (no seconds/year fields, no
+		// L/W/#): a crontab that lints clean can still fail here. Skip and
+		// log rather than aborting the whole daemon over one bad template.
+		sched, err := cron.ParseStandard(crontab)
+		if err != nil {
+			log.Println(templatePath, "has a crontab robfig/cron can't schedule, skipping:", err)
+			return nil
+		}
+
+		_, err = scheduler.AddFunc(crontab, func() {
+			firedAt := time.Now()
+
+			if alreadyFired(sched, state.lastFire(templatePath), firedAt) {
+				log.Println(templatePath, "already fired for the period covering", firedAt.Format(time.RFC3339), "- skipping to avoid a duplicate issue")
+				return
+			}
+
+			// Re-read and re-parse on every tick rather than reusing the
+			// metadata captured above: renderTemplate mutates Title and
+			// Description in place, and this closure is called repeatedly
+			// for the lifetime of the daemon.
+			contents, err := ioutil.ReadFile(templatePath)
+			if err != nil {
+				log.Println(templatePath, "failed to re-read template:", err)
+				return
+			}
+
+			data, err := parseMetadata(contents)
+			if err != nil {
+				log.Println(templatePath, "failed to parse template:", err)
+				return
+			}
+
+			data.NextTime = firedAt
+
+			log.Println(templatePath, "firing at", firedAt.Format(time.RFC3339))
+
+			if err := createIssue(data, templatePath, state); err != nil {
+				log.Println(templatePath, "failed to create issue:", err)
+				return
+			}
+
+			if err := state.recordFire(templatePath, firedAt); err != nil {
+				log.Println(templatePath, "failed to persist daemon state:", err)
+			}
+		})
+		if err != nil {
+			log.Println(templatePath, "failed to schedule, skipping:", err)
+			return nil
+		}
+
+		log.Println(templatePath, "scheduled with crontab", crontab, "- last fired", state.lastFire(templatePath).Format(time.RFC3339))
+
+		return nil
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gorhill/cronexpr"
+	"github.com/robfig/cron/v3"
+	"gitlab.com/gitlab-org/api/client-go"
+)
+
+const defaultLintOccurrences = 5
+
+// runLintMode walks issuesRelativePath, validates every template's
+// frontmatter and prints the next few times it would fire, without ever
+// calling git.Issues.CreateIssue. It exits non-zero if any template fails
+// validation, so it can gate a merge request pipeline.
+func runLintMode(occurrences int) {
+	if ciProjectID == "" {
+		ciProjectID = os.Getenv("CI_PROJECT_ID")
+	}
+	if ciProjectID == "" {
+		ciProjectID = os.Getenv("GITLAB_PROJECT_ID")
+	}
+
+	if ciAPIV4URL == "" {
+		ciAPIV4URL = os.Getenv("CI_API_V4_URL")
+	}
+	if ciAPIV4URL == "" {
+		ciAPIV4URL = os.Getenv("GITLAB_API_URL")
+	}
+	if ciAPIV4URL == "" {
+		log.Fatal("Environment variable 'CI_API_V4_URL' or 'GITLAB_API_URL' not found. --dry-run needs a GitLab instance to validate lookups against.")
+	}
+
+	if dir := os.Getenv("CI_PROJECT_DIR"); dir != "" {
+		issuesRelativePath = path.Join(dir, issuesRelativePath)
+	} else if override := os.Getenv("RECURRING_ISSUES_PATH"); override != "" {
+		issuesRelativePath = override
+	}
+
+	ciProjectRootNamespace = os.Getenv("CI_PROJECT_ROOT_NAMESPACE")
+
+	hadErrors := false
+
+	err := filepath.Walk(issuesRelativePath, lintTemplate(occurrences, &hadErrors))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if hadErrors {
+		os.Exit(1)
+	}
+}
+
+func lintTemplate(occurrences int, hadErrors *bool) filepath.WalkFunc {
+	return func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || filepath.Ext(path) != ".md" {
+			return nil
+		}
+
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		data, err := parseMetadata(contents)
+		if err != nil {
+			*hadErrors = true
+			fmt.Printf("%s: FAIL - could not parse frontmatter: %v\n", path, err)
+			return nil
+		}
+
+		issues := validateTemplate(data)
+		if len(issues) > 0 {
+			*hadErrors = true
+			fmt.Printf("%s: FAIL\n", path)
+			for _, issue := range issues {
+				fmt.Printf("  - %v\n", issue)
+			}
+			return nil
+		}
+
+		cronExpression, err := cronexpr.Parse(data.Crontab)
+		if err != nil {
+			*hadErrors = true
+			fmt.Printf("%s: FAIL - invalid crontab %q: %v\n", path, data.Crontab, err)
+			return nil
+		}
+
+		fmt.Printf("%s: OK - next %d occurrence(s):\n", path, occurrences)
+		for _, next := range cronExpression.NextN(time.Now(), uint(occurrences)) {
+			fmt.Printf("  - %s\n", next.Format(time.RFC3339))
+		}
+
+		return nil
+	}
+}
+
+// validateTemplate checks a template's fields and looks up its assignees,
+// labels, milestone, epic and iteration in GitLab, without creating
+// anything, and collects all of the failures instead of stopping at the
+// first one.
+func validateTemplate(data *metadata) []error {
+	var issues []error
+
+	if data.Title == "" {
+		issues = append(issues, fmt.Errorf("missing required field 'title'"))
+	}
+
+	if data.Crontab == "" {
+		issues = append(issues, fmt.Errorf("missing required field 'crontab'"))
+	} else if _, err := cronexpr.Parse(data.Crontab); err != nil {
+		issues = append(issues, fmt.Errorf("invalid crontab %q: %w", data.Crontab, err))
+	} else if _, err := cron.ParseStandard(data.Crontab); err != nil {
+		// Still a hard failure: the CI-pipeline path accepts anything
+		// cronexpr parses, but --daemon schedules with robfig/cron, which
+		// is stricter (no seconds/year fields, no L/W/#). A template that
+		// only passes cronexpr would be skipped by scheduleTemplate, which
+		// just logs it.
+		issues = append(issues, fmt.Errorf("crontab %q parses for the CI-pipeline path but not --daemon (robfig/cron): %w", data.Crontab, err))
+	}
+
+	if data.DueIn != "" {
+		if _, err := time.ParseDuration(data.DueIn); err != nil {
+			issues = append(issues, fmt.Errorf("invalid duein %q: %w", data.DueIn, err))
+		}
+	}
+
+	projectId := resolveProjectId(data)
+
+	for _, assignee := range data.Assignees {
+		if err := validateAssignee(assignee); err != nil {
+			issues = append(issues, fmt.Errorf("assignee %q: %w", assignee, err))
+		}
+	}
+
+	if len(data.Labels) > 0 {
+		if err := validateLabelsExist(projectId, data.Labels); err != nil {
+			issues = append(issues, err)
+		}
+	}
+
+	if data.Milestone != "" {
+		if _, err := getMilestoneId(projectId, data.Milestone); err != nil {
+			issues = append(issues, fmt.Errorf("milestone %q: %w", data.Milestone, err))
+		}
+	}
+
+	if data.Epic != "" || data.EpicIID != 0 {
+		groupId, err := getGroupIdFromNamespace()
+		if err != nil {
+			issues = append(issues, fmt.Errorf("epic lookup: %w", err))
+		} else if data.EpicIID != 0 {
+			if _, err := getEpicIdFromIID(groupId, data.EpicIID); err != nil {
+				issues = append(issues, fmt.Errorf("epic_iid %d: %w", data.EpicIID, err))
+			}
+		} else if _, err := getEpicId(groupId, data.Epic); err != nil {
+			issues = append(issues, fmt.Errorf("epic %q: %w", data.Epic, err))
+		}
+	}
+
+	if data.Iteration != "" {
+		groupId, err := getGroupIdFromNamespace()
+		if err != nil {
+			issues = append(issues, fmt.Errorf("iteration lookup: %w", err))
+		} else if _, err := getIterationId(groupId, data.Iteration); err != nil {
+			issues = append(issues, fmt.Errorf("iteration %q: %w", data.Iteration, err))
+		}
+	}
+
+	return issues
+}
+
+func resolveProjectId(data *metadata) int {
+	if data.ProjectId != 0 {
+		return data.ProjectId
+	}
+
+	projectId, _ := strconv.Atoi(ciProjectID)
+	return projectId
+}
+
+func validateAssignee(username string) error {
+	git, err := createGitlabClient()
+	if err != nil {
+		return err
+	}
+
+	users, _, err := git.Users.ListUsers(&gitlab.ListUsersOptions{Username: gitlab.Ptr(username)})
+	if err != nil {
+		return err
+	}
+
+	if len(users) != 1 {
+		return fmt.Errorf("expected one user for username %q but found %d", username, len(users))
+	}
+
+	return nil
+}
+
+func validateLabelsExist(projectId int, labels []string) error {
+	git, err := createGitlabClient()
+	if err != nil {
+		return err
+	}
+
+	existing, _, err := git.Labels.ListLabels(projectId, &gitlab.ListLabelsOptions{})
+	if err != nil {
+		return err
+	}
+
+	known := make(map[string]bool, len(existing))
+	for _, label := range existing {
+		known[label.Name] = true
+	}
+
+	for _, label := range labels {
+		if !known[label] {
+			return fmt.Errorf("label %q does not exist in project %d", label, projectId)
+		}
+	}
+
+	return nil
+}
@@ -1,278 +1,494 @@
-package main
-
-import (
-	"io/ioutil"
-	"log"
-	"os"
-	"path"
-	"path/filepath"
-	"strconv"
-	"time"
-
-	"github.com/ericaro/frontmatter"
-	"github.com/gorhill/cronexpr"
-	"github.com/xanzy/go-gitlab"
-)
-
-var (
-	ciAPIV4URL             string = ""
-	gitlabAPIToken         string = ""
-	ciProjectID            string = ""
-	ciProjectDir           string = ""
-	ciJobName              string = ""
-	ciProjectRootNamespace string = ""
-	issuesRelativePath     string = ".gitlab/recurring_issue_templates/"
-)
-
-type metadata struct {
-	Title        string   `yaml:"title"`
-	Description  string   `fm:"content" yaml:"-"`
-	Confidential bool     `yaml:"confidential"`
-	Assignees    []string `yaml:"assignees,flow"`
-	Labels       []string `yaml:"labels,flow"`
-	DueIn        string   `yaml:"duein"`
-	Crontab      string   `yaml:"crontab"`
-	Epic         string   `yaml:"epic"`
-	ProjectId    int      `yaml:"projectid"`
-	NextTime     time.Time
-}
-
-func processIssueFile(lastTime time.Time) filepath.WalkFunc {
-	return func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		if filepath.Ext(path) != ".md" {
-			log.Println(path, "does not end in .md, skipping file")
-			return nil
-		}
-
-		contents, err := ioutil.ReadFile(path)
-		if err != nil {
-			return err
-		}
-
-		data, err := parseMetadata(contents)
-		if err != nil {
-			return err
-		}
-
-		cronExpression, err := cronexpr.Parse(data.Crontab)
-		if err != nil {
-			return err
-		}
-
-		data.NextTime = cronExpression.Next(lastTime)
-
-		if data.NextTime.Before(time.Now()) {
-			log.Println(path, "was due", data.NextTime.Format(time.RFC3339), "- creating new issue")
-
-			err := createIssue(data)
-			if err != nil {
-				return err
-			}
-		} else {
-			log.Println(path, "is due", data.NextTime.Format(time.RFC3339))
-		}
-
-		return nil
-	}
-}
-
-func parseMetadata(contents []byte) (*metadata, error) {
-	data := new(metadata)
-	err := frontmatter.Unmarshal(contents, data)
-	if err != nil {
-		return nil, err
-	}
-
-	return data, nil
-}
-
-func createIssue(data *metadata) error {
-	git, err := createGitlabClient()
-	if err != nil {
-		return err
-	}
-
-	options := &gitlab.CreateIssueOptions{
-		Title:        gitlab.String(data.Title),
-		Description:  gitlab.String(data.Description),
-		Confidential: &data.Confidential,
-		CreatedAt:    &data.NextTime,
-	}
-
-	if data.DueIn != "" {
-		duration, err := time.ParseDuration(data.DueIn)
-		if err != nil {
-			return err
-		}
-
-		dueDate := gitlab.ISOTime(data.NextTime.Add(duration))
-
-		options.DueDate = &dueDate
-	}
-
-	issueProjectId, err := strconv.Atoi(ciProjectID)
-	if err != nil {
-		return err
-	}
-
-	if data.ProjectId != 0 {
-		issueProjectId = data.ProjectId
-	}
-
-	newIssue, _, err := git.Issues.CreateIssue(issueProjectId, options)
-	if err != nil {
-		return err
-	}
-
-	if data.Epic != "" {
-		groupId, err := getGroupIdFromNamespace()
-		if err != nil {
-			return err
-		}
-
-		epicId, err := getEpicId(groupId, data.Epic)
-		if err != nil {
-			return err
-		}
-
-		_, _, err = git.EpicIssues.AssignEpicIssue(groupId, epicId, newIssue.ID)
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
-func getGroupIdFromNamespace() (int, error) {
-	git, err := createGitlabClient()
-	if err != nil {
-		return 0, err
-	}
-
-	options := &gitlab.ListGroupsOptions{
-		Search:       &ciProjectRootNamespace,
-		TopLevelOnly: gitlab.Bool(true),
-		OrderBy:      gitlab.String("id"),
-	}
-
-	groups, _, err := git.Groups.ListGroups(options)
-	if err != nil {
-		return 0, err
-	}
-
-	if len(groups) != 1 {
-		log.Fatal("Expected one group for namespace", ciProjectRootNamespace, "but found multiple")
-	}
-
-	return groups[0].ID, nil
-}
-
-func getEpicId(groupId int, epicName string) (int, error) {
-	git, err := createGitlabClient()
-	if err != nil {
-		return 0, err
-	}
-
-	options := &gitlab.ListGroupEpicsOptions{
-		Search:                  &epicName,
-		IncludeDescendantGroups: gitlab.Bool(false),
-	}
-
-	epics, _, err := git.Epics.ListGroupEpics(groupId, options)
-	if err != nil {
-		return 0, err
-	}
-
-	if len(epics) != 1 {
-		log.Fatal("Expected one epic for epicName", epicName, "but found multiple")
-	}
-
-	return epics[0].ID, nil
-}
-
-func getLastRunTime() (time.Time, error) {
-	git, err := createGitlabClient()
-
-	if err != nil {
-		return time.Unix(0, 0), err
-	}
-
-	options := &gitlab.ListProjectPipelinesOptions{
-		Scope:   gitlab.String("finished"),
-		Status:  gitlab.BuildState(gitlab.Success),
-		OrderBy: gitlab.String("updated_at"),
-	}
-
-	pipelineInfos, _, err := git.Pipelines.ListProjectPipelines(ciProjectID, options)
-	if err != nil {
-		return time.Unix(0, 0), err
-	}
-
-	for _, pipelineInfo := range pipelineInfos {
-		jobs, _, err := git.Jobs.ListPipelineJobs(ciProjectID, pipelineInfo.ID, nil)
-		if err != nil {
-			return time.Unix(0, 0), err
-		}
-
-		for _, job := range jobs {
-			if job.Name == ciJobName {
-				return *job.FinishedAt, nil
-			}
-		}
-	}
-
-	return time.Unix(0, 0), nil
-}
-
-func main() {
-	gitlabAPIToken = os.Getenv("GITLAB_API_TOKEN")
-	if gitlabAPIToken == "" {
-		log.Fatal("Environment variable 'GITLAB_API_TOKEN' not found. Ensure this is set under the project CI/CD settings.")
-	}
-
-	ciAPIV4URL = os.Getenv("CI_API_V4_URL")
-	if ciAPIV4URL == "" {
-		log.Fatal("Environment variable 'CI_API_V4_URL' not found. This tool must be ran as part of a GitLab pipeline.")
-	}
-
-	ciProjectID = os.Getenv("CI_PROJECT_ID")
-	if ciProjectID == "" {
-		log.Fatal("Environment variable 'CI_PROJECT_ID' not found. This tool must be ran as part of a GitLab pipeline.")
-	}
-
-	ciProjectDir = os.Getenv("CI_PROJECT_DIR")
-	if ciProjectDir == "" {
-		log.Fatal("Environment variable 'CI_PROJECT_DIR' not found. This tool must be ran as part of a GitLab pipeline.")
-	}
-
-	ciJobName = os.Getenv("CI_JOB_NAME")
-	if ciJobName == "" {
-		log.Fatal("Environment variable 'CI_JOB_NAME' not found. This tool must be ran as part of a GitLab pipeline.")
-	}
-
-	ciProjectRootNamespace = os.Getenv("CI_PROJECT_ROOT_NAMESPACE")
-	if ciProjectRootNamespace == "" {
-		log.Fatal("Environment variable 'CI_PROJECT_ROOT_NAMESPACE' not found. This tool must be ran as part of a GitLab pipeline.")
-	}
-
-	issuesRelativePath = path.Join(ciProjectDir, issuesRelativePath)
-
-	lastRunTime, err := getLastRunTime()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	log.Println("Last run:", lastRunTime.Format(time.RFC3339))
-
-	err = filepath.Walk(issuesRelativePath, processIssueFile(lastRunTime))
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	log.Println("Run complete")
-}
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/ericaro/frontmatter"
+	"github.com/gorhill/cronexpr"
+	"gitlab.com/gitlab-org/api/client-go"
+)
+
+var (
+	ciAPIV4URL             string = ""
+	gitlabAPIToken         string = ""
+	ciProjectID            string = ""
+	ciProjectDir           string = ""
+	ciJobName              string = ""
+	ciProjectRootNamespace string = ""
+	issuesRelativePath     string = ".gitlab/recurring_issue_templates/"
+)
+
+type metadata struct {
+	Title          string   `yaml:"title"`
+	Description    string   `fm:"content" yaml:"-"`
+	Confidential   bool     `yaml:"confidential"`
+	Assignees      []string `yaml:"assignees,flow"`
+	Labels         []string `yaml:"labels,flow"`
+	DueIn          string   `yaml:"duein"`
+	Crontab        string   `yaml:"crontab"`
+	Epic           string   `yaml:"epic"`
+	EpicIID        int      `yaml:"epic_iid"`
+	Iteration      string   `yaml:"iteration"`
+	Milestone      string   `yaml:"milestone"`
+	Weight         int      `yaml:"weight"`
+	ProjectId      int      `yaml:"projectid"`
+	Template       bool     `yaml:"template"`
+	ParentIssueIID int      `yaml:"parent_issue_iid"`
+	LinkPrevious   bool     `yaml:"link_previous"`
+	NextTime       time.Time
+}
+
+func processIssueFile(lastTime time.Time, state *runState) filepath.WalkFunc {
+	return func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if filepath.Ext(path) != ".md" {
+			log.Println(path, "does not end in .md, skipping file")
+			return nil
+		}
+
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		data, err := parseMetadata(contents)
+		if err != nil {
+			return err
+		}
+
+		cronExpression, err := cronexpr.Parse(data.Crontab)
+		if err != nil {
+			return err
+		}
+
+		data.NextTime = cronExpression.Next(lastTime)
+
+		if data.NextTime.Before(time.Now()) {
+			log.Println(path, "was due", data.NextTime.Format(time.RFC3339), "- creating new issue")
+
+			err := createIssue(data, path, state)
+			if err != nil {
+				return err
+			}
+		} else {
+			log.Println(path, "is due", data.NextTime.Format(time.RFC3339))
+		}
+
+		return nil
+	}
+}
+
+func parseMetadata(contents []byte) (*metadata, error) {
+	data := new(metadata)
+	err := frontmatter.Unmarshal(contents, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func createIssue(data *metadata, templatePath string, state *runState) error {
+	if err := renderTemplate(data, templatePath, state); err != nil {
+		return err
+	}
+
+	git, err := createGitlabClient()
+	if err != nil {
+		return err
+	}
+
+	options := &gitlab.CreateIssueOptions{
+		Title:        gitlab.Ptr(data.Title),
+		Description:  gitlab.Ptr(data.Description),
+		Confidential: &data.Confidential,
+		CreatedAt:    &data.NextTime,
+	}
+
+	if data.DueIn != "" {
+		duration, err := time.ParseDuration(data.DueIn)
+		if err != nil {
+			return err
+		}
+
+		dueDate := gitlab.ISOTime(data.NextTime.Add(duration))
+
+		options.DueDate = &dueDate
+	}
+
+	issueProjectId, err := strconv.Atoi(ciProjectID)
+	if err != nil {
+		return err
+	}
+
+	if data.ProjectId != 0 {
+		issueProjectId = data.ProjectId
+	}
+
+	if data.Weight != 0 {
+		options.Weight = gitlab.Ptr(data.Weight)
+	}
+
+	if data.Milestone != "" {
+		milestoneId, err := getMilestoneId(issueProjectId, data.Milestone)
+		if err != nil {
+			return err
+		}
+
+		options.MilestoneID = gitlab.Ptr(milestoneId)
+	}
+
+	assignIteration := data.Iteration != ""
+	if assignIteration {
+		groupId, err := getGroupIdFromNamespace()
+		if err != nil {
+			return err
+		}
+
+		if _, err := getIterationId(groupId, data.Iteration); err != nil {
+			return err
+		}
+	}
+
+	templateLabel := recurringTemplateLabel(templatePath)
+	labels := append(append([]string{}, data.Labels...), templateLabel)
+	options.Labels = gitlab.Ptr(gitlab.LabelOptions(labels))
+
+	newIssue, _, err := git.Issues.CreateIssue(issueProjectId, options)
+	if err != nil {
+		return err
+	}
+
+	if assignIteration {
+		if err := setIssueIteration(git, issueProjectId, newIssue.IID, data.Iteration); err != nil {
+			return err
+		}
+	}
+
+	if data.ParentIssueIID != 0 {
+		if err := linkIssues(git, issueProjectId, newIssue.IID, data.ParentIssueIID); err != nil {
+			return err
+		}
+	}
+
+	if data.LinkPrevious {
+		previousIID, err := findPreviousOccurrence(git, issueProjectId, templateLabel, newIssue.IID)
+		if err != nil {
+			return err
+		}
+
+		if previousIID != 0 {
+			if err := linkIssues(git, issueProjectId, newIssue.IID, previousIID); err != nil {
+				return err
+			}
+		}
+	}
+
+	if data.Epic != "" || data.EpicIID != 0 {
+		groupId, err := getGroupIdFromNamespace()
+		if err != nil {
+			return err
+		}
+
+		var epicId int
+		if data.EpicIID != 0 {
+			epicId, err = getEpicIdFromIID(groupId, data.EpicIID)
+		} else {
+			epicId, err = getEpicId(groupId, data.Epic)
+		}
+		if err != nil {
+			return err
+		}
+
+		_, _, err = git.EpicIssues.AssignEpicIssue(groupId, epicId, newIssue.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func getGroupIdFromNamespace() (int, error) {
+	git, err := createGitlabClient()
+	if err != nil {
+		return 0, err
+	}
+
+	options := &gitlab.ListGroupsOptions{
+		Search:       &ciProjectRootNamespace,
+		TopLevelOnly: gitlab.Ptr(true),
+		OrderBy:      gitlab.Ptr("id"),
+	}
+
+	groups, _, err := git.Groups.ListGroups(options)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(groups) != 1 {
+		return 0, fmt.Errorf("expected one group for namespace %q but found %d", ciProjectRootNamespace, len(groups))
+	}
+
+	return groups[0].ID, nil
+}
+
+func getEpicId(groupId int, epicName string) (int, error) {
+	git, err := createGitlabClient()
+	if err != nil {
+		return 0, err
+	}
+
+	options := &gitlab.ListGroupEpicsOptions{
+		Search:                  &epicName,
+		IncludeDescendantGroups: gitlab.Ptr(false),
+	}
+
+	epics, _, err := git.Epics.ListGroupEpics(groupId, options)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(epics) != 1 {
+		return 0, fmt.Errorf("expected one epic for epicName %q but found %d", epicName, len(epics))
+	}
+
+	return epics[0].ID, nil
+}
+
+func getEpicIdFromIID(groupId int, epicIID int) (int, error) {
+	git, err := createGitlabClient()
+	if err != nil {
+		return 0, err
+	}
+
+	epic, _, err := git.Epics.GetEpic(groupId, epicIID)
+	if err != nil {
+		return 0, err
+	}
+
+	return epic.ID, nil
+}
+
+func getMilestoneId(projectId int, title string) (int, error) {
+	git, err := createGitlabClient()
+	if err != nil {
+		return 0, err
+	}
+
+	options := &gitlab.ListMilestonesOptions{
+		Search: gitlab.Ptr(title),
+	}
+
+	milestones, _, err := git.Milestones.ListMilestones(projectId, options)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(milestones) != 1 {
+		return 0, fmt.Errorf("expected one milestone for title %q but found %d", title, len(milestones))
+	}
+
+	return milestones[0].ID, nil
+}
+
+func getIterationId(groupId int, title string) (int, error) {
+	git, err := createGitlabClient()
+	if err != nil {
+		return 0, err
+	}
+
+	options := &gitlab.ListGroupIterationsOptions{
+		Search: gitlab.Ptr(title),
+	}
+
+	iterations, _, err := git.GroupIterations.ListGroupIterations(groupId, options)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(iterations) != 1 {
+		return 0, fmt.Errorf("expected one iteration for title %q but found %d", title, len(iterations))
+	}
+
+	return iterations[0].ID, nil
+}
+
+// setIssueIteration assigns an iteration to an existing issue. The GitLab
+// REST API has no iteration_id parameter on create/update issue, so this is
+// done the same way the web UI does it: a `/iteration` quick action posted
+// as a note, matched by iteration title.
+func setIssueIteration(git *gitlab.Client, projectId int, issueIID int, iterationTitle string) error {
+	body := fmt.Sprintf("/iteration *iteration:%q", iterationTitle)
+
+	_, _, err := git.Notes.CreateIssueNote(projectId, issueIID, &gitlab.CreateIssueNoteOptions{
+		Body: gitlab.Ptr(body),
+	})
+
+	return err
+}
+
+// recurringTemplateLabel is added to every issue created from templatePath
+// so occurrences of the same template can be found later, e.g. by
+// findPreviousOccurrence for `link_previous`.
+func recurringTemplateLabel(templatePath string) string {
+	return fmt.Sprintf("recurring-template:%s", filepath.Base(templatePath))
+}
+
+func linkIssues(git *gitlab.Client, projectId int, sourceIID int, targetIID int) error {
+	_, _, err := git.IssueLinks.CreateIssueLink(projectId, sourceIID, &gitlab.CreateIssueLinkOptions{
+		TargetProjectID: gitlab.Ptr(strconv.Itoa(projectId)),
+		TargetIssueIID:  gitlab.Ptr(strconv.Itoa(targetIID)),
+	})
+
+	return err
+}
+
+func findPreviousOccurrence(git *gitlab.Client, projectId int, templateLabel string, excludeIID int) (int, error) {
+	options := &gitlab.ListProjectIssuesOptions{
+		Labels:  gitlab.Ptr(gitlab.LabelOptions{templateLabel}),
+		OrderBy: gitlab.Ptr("created_at"),
+		Sort:    gitlab.Ptr("desc"),
+	}
+
+	issues, _, err := git.Issues.ListProjectIssues(projectId, options)
+	if err != nil {
+		return 0, err
+	}
+
+	return firstOtherIssueIID(issues, excludeIID), nil
+}
+
+// firstOtherIssueIID returns the IID of the first issue in issues (assumed
+// sorted most-recent-first by the ListProjectIssues call above) that isn't
+// excludeIID, the issue just created, or 0 if there is none.
+func firstOtherIssueIID(issues []*gitlab.Issue, excludeIID int) int {
+	for _, issue := range issues {
+		if issue.IID != excludeIID {
+			return issue.IID
+		}
+	}
+
+	return 0
+}
+
+func getLastRunTime() (time.Time, error) {
+	git, err := createGitlabClient()
+
+	if err != nil {
+		return time.Unix(0, 0), err
+	}
+
+	options := &gitlab.ListProjectPipelinesOptions{
+		Scope:   gitlab.Ptr("finished"),
+		Status:  gitlab.Ptr(gitlab.Success),
+		OrderBy: gitlab.Ptr("updated_at"),
+	}
+
+	pipelineInfos, _, err := git.Pipelines.ListProjectPipelines(ciProjectID, options)
+	if err != nil {
+		return time.Unix(0, 0), err
+	}
+
+	for _, pipelineInfo := range pipelineInfos {
+		jobs, _, err := git.Jobs.ListPipelineJobs(ciProjectID, pipelineInfo.ID, nil)
+		if err != nil {
+			return time.Unix(0, 0), err
+		}
+
+		for _, job := range jobs {
+			if job.Name == ciJobName {
+				return *job.FinishedAt, nil
+			}
+		}
+	}
+
+	return time.Unix(0, 0), nil
+}
+
+func main() {
+	daemon := flag.Bool("daemon", false, "run as a long-lived daemon with its own embedded cron scheduler, instead of a single GitLab CI pipeline run")
+	dryRun := flag.Bool("dry-run", false, "validate recurring issue templates and print their upcoming firing times without creating any issues")
+	occurrences := flag.Int("occurrences", defaultLintOccurrences, "number of upcoming firing times to print per template in --dry-run mode")
+	flag.Parse()
+
+	daemonMode := *daemon || os.Getenv("MODE") == "daemon"
+
+	gitlabAPIToken = os.Getenv("GITLAB_API_TOKEN")
+
+	if *dryRun {
+		runLintMode(*occurrences)
+		return
+	}
+
+	if daemonMode {
+		runDaemonMode()
+		return
+	}
+
+	if gitlabAPIToken == "" {
+		log.Fatal("Environment variable 'GITLAB_API_TOKEN' not found. Ensure this is set under the project CI/CD settings.")
+	}
+
+	ciAPIV4URL = os.Getenv("CI_API_V4_URL")
+	if ciAPIV4URL == "" {
+		log.Fatal("Environment variable 'CI_API_V4_URL' not found. This tool must be ran as part of a GitLab pipeline.")
+	}
+
+	ciProjectID = os.Getenv("CI_PROJECT_ID")
+	if ciProjectID == "" {
+		log.Fatal("Environment variable 'CI_PROJECT_ID' not found. This tool must be ran as part of a GitLab pipeline.")
+	}
+
+	ciProjectDir = os.Getenv("CI_PROJECT_DIR")
+	if ciProjectDir == "" {
+		log.Fatal("Environment variable 'CI_PROJECT_DIR' not found. This tool must be ran as part of a GitLab pipeline.")
+	}
+
+	ciJobName = os.Getenv("CI_JOB_NAME")
+	if ciJobName == "" {
+		log.Fatal("Environment variable 'CI_JOB_NAME' not found. This tool must be ran as part of a GitLab pipeline.")
+	}
+
+	ciProjectRootNamespace = os.Getenv("CI_PROJECT_ROOT_NAMESPACE")
+	if ciProjectRootNamespace == "" {
+		log.Fatal("Environment variable 'CI_PROJECT_ROOT_NAMESPACE' not found. This tool must be ran as part of a GitLab pipeline.")
+	}
+
+	issuesRelativePath = path.Join(ciProjectDir, issuesRelativePath)
+
+	stateFilePath := os.Getenv("STATE_FILE_PATH")
+	if stateFilePath == "" {
+		stateFilePath = defaultStateFilePath
+	}
+
+	state, err := loadRunState(stateFilePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	lastRunTime, err := getLastRunTime()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Println("Last run:", lastRunTime.Format(time.RFC3339))
+
+	err = filepath.Walk(issuesRelativePath, processIssueFile(lastRunTime, state))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Println("Run complete")
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"os"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/adrg/frontmatter"
+	"github.com/robfig/cron/v3"
+	"gitlab.com/gitlab-org/api/client-go"
 )
 
 func Test_parsContent(t *testing.T) {
@@ -157,3 +161,351 @@ Test Content
 		})
 	}
 }
+
+func Test_renderText(t *testing.T) {
+	type args struct {
+		text    string
+		context templateContext
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "Renders now",
+			args: args{
+				text:    `Weekly ops review — {{ .Now.Format "2006-01-02" }}`,
+				context: templateContext{Now: time.Date(2023, time.March, 6, 0, 0, 0, 0, time.UTC)},
+			},
+			want: "Weekly ops review — 2023-03-06",
+		},
+		{
+			name: "Renders counter",
+			args: args{
+				text:    "Week {{ .Counter }} checklist",
+				context: templateContext{Counter: 3},
+			},
+			want: "Week 3 checklist",
+		},
+		{
+			name: "Renders env",
+			args: args{
+				text:    "{{ .Env.CI_ENVIRONMENT_NAME }}",
+				context: templateContext{Env: map[string]string{"CI_ENVIRONMENT_NAME": "production"}},
+			},
+			want: "production",
+		},
+		{
+			name: "Returns an error for invalid template syntax",
+			args: args{
+				text:    "{{ .Now",
+				context: templateContext{},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderText(tt.args.text, tt.args.context)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("renderText() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("renderText() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_recurringTemplateLabel(t *testing.T) {
+	type args struct {
+		templatePath string
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		{
+			name: "Uses the template's base name",
+			args: args{templatePath: "weekly-ops-review.md"},
+			want: "recurring-template:weekly-ops-review.md",
+		},
+		{
+			name: "Strips the directory",
+			args: args{templatePath: "/ci/recurring_issue_templates/weekly-ops-review.md"},
+			want: "recurring-template:weekly-ops-review.md",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := recurringTemplateLabel(tt.args.templatePath); got != tt.want {
+				t.Errorf("recurringTemplateLabel() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_firstOtherIssueIID(t *testing.T) {
+	type args struct {
+		issues     []*gitlab.Issue
+		excludeIID int
+	}
+	tests := []struct {
+		name string
+		args args
+		want int
+	}{
+		{
+			name: "Returns the most recent issue that isn't excluded",
+			args: args{
+				issues:     []*gitlab.Issue{{IID: 5}, {IID: 3}, {IID: 1}},
+				excludeIID: 5,
+			},
+			want: 3,
+		},
+		{
+			name: "Skips the excluded issue even if it isn't first",
+			args: args{
+				issues:     []*gitlab.Issue{{IID: 3}, {IID: 5}, {IID: 1}},
+				excludeIID: 5,
+			},
+			want: 3,
+		},
+		{
+			name: "Returns 0 when there is no other occurrence",
+			args: args{
+				issues:     []*gitlab.Issue{{IID: 5}},
+				excludeIID: 5,
+			},
+			want: 0,
+		},
+		{
+			name: "Returns 0 for an empty result",
+			args: args{
+				issues:     nil,
+				excludeIID: 5,
+			},
+			want: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := firstOtherIssueIID(tt.args.issues, tt.args.excludeIID); got != tt.want {
+				t.Errorf("firstOtherIssueIID() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_selectAuthMode(t *testing.T) {
+	for _, key := range []string{"GITLAB_OAUTH_TOKEN", "CI_JOB_TOKEN"} {
+		if v, ok := os.LookupEnv(key); ok {
+			defer os.Setenv(key, v)
+		} else {
+			defer os.Unsetenv(key)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		oauthToken string
+		jobToken   string
+		want       authMode
+	}{
+		{
+			name: "Falls back to the personal access token",
+			want: authPersonalAccessToken,
+		},
+		{
+			name:       "Prefers an OAuth token when set",
+			oauthToken: "oauth-token",
+			want:       authOAuth,
+		},
+		{
+			name:     "Uses the CI job token when set",
+			jobToken: "job-token",
+			want:     authJobToken,
+		},
+		{
+			name:       "Prefers OAuth over the job token",
+			oauthToken: "oauth-token",
+			jobToken:   "job-token",
+			want:       authOAuth,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("GITLAB_OAUTH_TOKEN", tt.oauthToken)
+			os.Setenv("CI_JOB_TOKEN", tt.jobToken)
+
+			if got := selectAuthMode(); got != tt.want {
+				t.Errorf("selectAuthMode() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_buildTLSTransport(t *testing.T) {
+	for _, key := range []string{"GITLAB_INSECURE", "GITLAB_CA_CERT", "GITLAB_CA_CERT_FILE"} {
+		if v, ok := os.LookupEnv(key); ok {
+			defer os.Setenv(key, v)
+		} else {
+			defer os.Unsetenv(key)
+		}
+		os.Unsetenv(key)
+	}
+
+	t.Run("Verifies the server certificate by default", func(t *testing.T) {
+		transport, err := buildTLSTransport()
+		if err != nil {
+			t.Fatalf("buildTLSTransport() error = %v", err)
+		}
+		if transport.TLSClientConfig.InsecureSkipVerify {
+			t.Error("buildTLSTransport() disabled verification without GITLAB_INSECURE set")
+		}
+	})
+
+	t.Run("Honors GITLAB_INSECURE", func(t *testing.T) {
+		os.Setenv("GITLAB_INSECURE", "1")
+		defer os.Unsetenv("GITLAB_INSECURE")
+
+		transport, err := buildTLSTransport()
+		if err != nil {
+			t.Fatalf("buildTLSTransport() error = %v", err)
+		}
+		if !transport.TLSClientConfig.InsecureSkipVerify {
+			t.Error("buildTLSTransport() did not disable verification with GITLAB_INSECURE=1")
+		}
+	})
+
+	t.Run("Rejects an unparseable GITLAB_CA_CERT", func(t *testing.T) {
+		os.Setenv("GITLAB_CA_CERT", "not a certificate")
+		defer os.Unsetenv("GITLAB_CA_CERT")
+
+		if _, err := buildTLSTransport(); err == nil {
+			t.Error("buildTLSTransport() expected an error for an invalid GITLAB_CA_CERT")
+		}
+	})
+}
+
+func Test_alreadyFired(t *testing.T) {
+	sched, err := cron.ParseStandard("0 9 * * *")
+	if err != nil {
+		t.Fatalf("cron.ParseStandard() error = %v", err)
+	}
+
+	type args struct {
+		lastFired time.Time
+		firedAt   time.Time
+	}
+	tests := []struct {
+		name string
+		args args
+		want bool
+	}{
+		{
+			name: "Never fired before",
+			args: args{
+				lastFired: time.Unix(0, 0),
+				firedAt:   time.Date(2023, time.March, 6, 9, 0, 0, 0, time.UTC),
+			},
+			want: false,
+		},
+		{
+			name: "Firing for a new period after the last fire",
+			args: args{
+				lastFired: time.Date(2023, time.March, 6, 9, 0, 0, 0, time.UTC),
+				firedAt:   time.Date(2023, time.March, 7, 9, 0, 0, 0, time.UTC),
+			},
+			want: false,
+		},
+		{
+			name: "Restart landing on the same period as the last fire",
+			args: args{
+				lastFired: time.Date(2023, time.March, 6, 9, 0, 0, 0, time.UTC),
+				firedAt:   time.Date(2023, time.March, 6, 9, 0, 1, 0, time.UTC),
+			},
+			want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := alreadyFired(sched, tt.args.lastFired, tt.args.firedAt); got != tt.want {
+				t.Errorf("alreadyFired() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_runState(t *testing.T) {
+	t.Run("lastFire defaults to the Unix epoch for an unknown template", func(t *testing.T) {
+		state := &runState{path: t.TempDir() + "/state.json", LastFired: map[string]time.Time{}, Counters: map[string]int{}}
+
+		if got := state.lastFire("unknown.md"); got != time.Unix(0, 0) {
+			t.Errorf("lastFire() = %v, want %v", got, time.Unix(0, 0))
+		}
+	})
+
+	t.Run("recordFire persists LastFired and survives a reload", func(t *testing.T) {
+		path := t.TempDir() + "/state.json"
+		state := &runState{path: path, LastFired: map[string]time.Time{}, Counters: map[string]int{}}
+
+		firedAt := time.Date(2023, time.March, 6, 9, 0, 0, 0, time.UTC)
+		if err := state.recordFire("weekly.md", firedAt); err != nil {
+			t.Fatalf("recordFire() error = %v", err)
+		}
+
+		if got := state.lastFire("weekly.md"); !got.Equal(firedAt) {
+			t.Errorf("lastFire() = %v, want %v", got, firedAt)
+		}
+
+		reloaded, err := loadRunState(path)
+		if err != nil {
+			t.Fatalf("loadRunState() error = %v", err)
+		}
+		if got := reloaded.lastFire("weekly.md"); !got.Equal(firedAt) {
+			t.Errorf("lastFire() after reload = %v, want %v", got, firedAt)
+		}
+	})
+
+	t.Run("nextCounter increments per template and persists", func(t *testing.T) {
+		path := t.TempDir() + "/state.json"
+		state := &runState{path: path, LastFired: map[string]time.Time{}, Counters: map[string]int{}}
+
+		for i, want := range []int{1, 2, 3} {
+			got, err := state.nextCounter("weekly.md")
+			if err != nil {
+				t.Fatalf("nextCounter() iteration %d error = %v", i, err)
+			}
+			if got != want {
+				t.Errorf("nextCounter() iteration %d = %v, want %v", i, got, want)
+			}
+		}
+
+		if got, err := state.nextCounter("other.md"); err != nil || got != 1 {
+			t.Errorf("nextCounter() for a different template = %v, %v, want 1, nil", got, err)
+		}
+
+		reloaded, err := loadRunState(path)
+		if err != nil {
+			t.Fatalf("loadRunState() error = %v", err)
+		}
+		if got, err := reloaded.nextCounter("weekly.md"); err != nil || got != 4 {
+			t.Errorf("nextCounter() after reload = %v, %v, want 4, nil", got, err)
+		}
+	})
+
+	t.Run("loadRunState returns an empty state for a missing file", func(t *testing.T) {
+		state, err := loadRunState(t.TempDir() + "/does-not-exist.json")
+		if err != nil {
+			t.Fatalf("loadRunState() error = %v", err)
+		}
+		if got := state.lastFire("weekly.md"); got != time.Unix(0, 0) {
+			t.Errorf("lastFire() = %v, want %v", got, time.Unix(0, 0))
+		}
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultStateFilePath = "recurring-issues-state.json"
+
+// runState tracks per-template bookkeeping that needs to survive a process
+// restart: the last time a template fired (so daemon mode doesn't re-fire
+// something already due) and a monotonically increasing counter exposed to
+// rendered templates as .Counter.
+type runState struct {
+	mu   sync.Mutex
+	path string
+
+	LastFired map[string]time.Time `json:"lastFired"`
+	Counters  map[string]int       `json:"counters"`
+}
+
+func loadRunState(path string) (*runState, error) {
+	state := &runState{path: path, LastFired: map[string]time.Time{}, Counters: map[string]int{}}
+
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(contents, state); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+func (s *runState) lastFire(templatePath string) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t, ok := s.LastFired[templatePath]; ok {
+		return t
+	}
+
+	return time.Unix(0, 0)
+}
+
+func (s *runState) recordFire(templatePath string, firedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.LastFired[templatePath] = firedAt
+
+	return s.persistLocked()
+}
+
+func (s *runState) nextCounter(templatePath string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Counters[templatePath]++
+	count := s.Counters[templatePath]
+
+	return count, s.persistLocked()
+}
+
+func (s *runState) persistLocked() error {
+	contents, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(s.path, contents, 0644)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templateContext is the data made available to a template's title and
+// description when metadata.Template is true.
+type templateContext struct {
+	Now       time.Time
+	DueDate   time.Time
+	Iteration string
+	Counter   int
+	Env       map[string]string
+}
+
+// renderTemplate renders data.Title and data.Description as text/template
+// bodies when the template opts in with `template: true`, so literal
+// templates keep behaving exactly as before.
+func renderTemplate(data *metadata, templatePath string, state *runState) error {
+	if !data.Template {
+		return nil
+	}
+
+	var dueDate time.Time
+	if data.DueIn != "" {
+		duration, err := time.ParseDuration(data.DueIn)
+		if err != nil {
+			return err
+		}
+
+		dueDate = data.NextTime.Add(duration)
+	}
+
+	counter, err := state.nextCounter(templatePath)
+	if err != nil {
+		return err
+	}
+
+	context := templateContext{
+		Now:       data.NextTime,
+		DueDate:   dueDate,
+		Iteration: data.Iteration,
+		Counter:   counter,
+		Env:       environAsMap(),
+	}
+
+	title, err := renderText(data.Title, context)
+	if err != nil {
+		return err
+	}
+	data.Title = title
+
+	description, err := renderText(data.Description, context)
+	if err != nil {
+		return err
+	}
+	data.Description = description
+
+	return nil
+}
+
+func renderText(text string, context templateContext) (string, error) {
+	tmpl, err := template.New("recurring-issue").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, context); err != nil {
+		return "", err
+	}
+
+	return rendered.String(), nil
+}
+
+func environAsMap() map[string]string {
+	env := make(map[string]string)
+
+	for _, entry := range os.Environ() {
+		key, value, found := strings.Cut(entry, "=")
+		if found {
+			env[key] = value
+		}
+	}
+
+	return env
+}